@@ -0,0 +1,158 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunks"
+)
+
+// ErrRangeExceedsBlockSize is returned by BlockWriter.Add when a sample's
+// timestamp would push the block's time range past the configured block
+// size.
+var ErrRangeExceedsBlockSize = errors.New("tsdb: sample time range exceeds configured block size")
+
+// BlockWriter writes samples directly into an immutable TSDB block, without
+// going through a WAL or a long-lived head, so batch importers (CSV or
+// OpenMetrics loaders, for example) can produce blocks that Open will pick
+// up the next time it starts.
+type BlockWriter struct {
+	logger    log.Logger
+	dir       string
+	blockSize int64
+
+	head *tsdb.Head
+	mint int64
+	maxt int64
+	set  bool
+}
+
+// NewBlockWriter returns a BlockWriter that assembles a single block of at
+// most blockSize milliseconds under dir. Call Appender to obtain a
+// storage.Appender, add samples to it, then call Flush to persist the block.
+func NewBlockWriter(logger log.Logger, dir string, blockSize int64) (*BlockWriter, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, errors.Wrap(err, "create block writer dir")
+	}
+
+	chunkDir, err := ioutil.TempDir(dir, "chunks_head")
+	if err != nil {
+		return nil, errors.Wrap(err, "create chunk disk mapper dir")
+	}
+	mapper, err := chunks.NewChunkDiskMapper(chunkDir, chunks.DefaultChunkSegmentSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "create chunk disk mapper")
+	}
+
+	head, err := tsdb.NewHead(nil, logger, nil, blockSize, mapper)
+	if err != nil {
+		return nil, errors.Wrap(err, "create head")
+	}
+
+	return &BlockWriter{
+		logger:    logger,
+		dir:       dir,
+		blockSize: blockSize,
+		head:      head,
+	}, nil
+}
+
+// Appender returns a storage.Appender that buffers samples in the writer's
+// in-memory head until Flush is called. Samples whose timestamp would
+// stretch the block's range past blockSize are rejected with
+// ErrRangeExceedsBlockSize. A BlockWriter is single-use: calling Appender
+// after Flush returns an error rather than an appender, since Flush has
+// already torn down the underlying head.
+func (w *BlockWriter) Appender() (storage.Appender, error) {
+	if w.head == nil {
+		return nil, errors.New("tsdb: block writer already flushed")
+	}
+	return &blockWriterAppender{w: w, a: w.head.Appender()}, nil
+}
+
+func (w *BlockWriter) observe(t int64) error {
+	if !w.set {
+		w.mint, w.maxt, w.set = t, t, true
+		return nil
+	}
+	mint, maxt := w.mint, w.maxt
+	if t < mint {
+		mint = t
+	}
+	if t > maxt {
+		maxt = t
+	}
+	if maxt-mint > w.blockSize {
+		return ErrRangeExceedsBlockSize
+	}
+	w.mint, w.maxt = mint, maxt
+	return nil
+}
+
+// Flush compacts the buffered samples into an immutable block under the
+// writer's directory and returns its ULID and on-disk path. A BlockWriter is
+// single-use: its head is torn down afterwards, so Flush (and Appender)
+// cannot be called again - RangeAppender relies on this, which is why it
+// always constructs a fresh BlockWriter via rotate() instead of reusing one.
+func (w *BlockWriter) Flush(ctx context.Context) (ulid.ULID, string, error) {
+	if !w.set {
+		return ulid.ULID{}, "", errors.New("tsdb: no samples appended")
+	}
+
+	compactor, err := tsdb.NewLeveledCompactor(ctx, nil, w.logger, []int64{w.blockSize}, nil)
+	if err != nil {
+		return ulid.ULID{}, "", errors.Wrap(err, "create leveled compactor")
+	}
+
+	id, err := compactor.Write(w.dir, w.head, w.mint, w.maxt+1, nil)
+	if err != nil {
+		return ulid.ULID{}, "", errors.Wrap(err, "write block")
+	}
+
+	w.head = nil
+	w.set = false
+
+	return id, w.dir + "/" + id.String(), nil
+}
+
+type blockWriterAppender struct {
+	w *BlockWriter
+	a tsdb.Appender
+}
+
+func (a *blockWriterAppender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
+	if err := a.w.observe(t); err != nil {
+		return 0, err
+	}
+	return a.a.Add(lset, t, v)
+}
+
+func (a *blockWriterAppender) AddFast(lset labels.Labels, ref uint64, t int64, v float64) error {
+	if err := a.w.observe(t); err != nil {
+		return err
+	}
+	return a.a.AddFast(ref, t, v)
+}
+
+func (a *blockWriterAppender) Commit() error   { return a.a.Commit() }
+func (a *blockWriterAppender) Rollback() error { return a.a.Rollback() }
@@ -0,0 +1,228 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// listBlockDirs lists the distinct block directories (ULID prefixes) shipped
+// to the bucket. Bucket.Iter walks individual object keys (<ulid>/index,
+// <ulid>/chunks/000001, <ulid>/meta.json, ...), so this groups them back
+// into one entry per block instead of treating each file as its own block.
+func listBlockDirs(ctx context.Context, bucket Bucket) ([]string, error) {
+	seen := map[string]struct{}{}
+	var dirs []string
+	err := bucket.Iter(ctx, "", func(name string) error {
+		dir := name
+		if i := strings.Index(name, "/"); i >= 0 {
+			dir = name[:i]
+		}
+		if _, ok := seen[dir]; ok {
+			return nil
+		}
+		seen[dir] = struct{}{}
+		dirs = append(dirs, dir)
+		return nil
+	})
+	return dirs, err
+}
+
+// bucketQuerier answers queries against blocks that have been shipped to the
+// remote bucket and are no longer held on local disk. For each block whose
+// time range overlaps [mint,maxt] it downloads the whole index, and fetches
+// whole chunk segment files on demand; it does not fetch byte ranges within
+// those files.
+type bucketQuerier struct {
+	ctx        context.Context
+	bucket     Bucket
+	mint, maxt int64
+}
+
+func (q *bucketQuerier) Select(p *storage.SelectParams, ms ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	var set storage.SeriesSet = storage.EmptySeriesSet()
+	var warnings storage.Warnings
+
+	dirs, err := listBlockDirs(q.ctx, q.bucket)
+	if err != nil {
+		return nil, warnings, err
+	}
+
+	for _, dir := range dirs {
+		meta, err := readRemoteMeta(q.ctx, q.bucket, dir)
+		if err != nil {
+			// A single unreadable/corrupt block shouldn't fail the whole
+			// query; skip it and surface the problem as a warning.
+			warnings = append(warnings, errors.Wrapf(err, "read meta for remote block %s", dir))
+			continue
+		}
+		if meta.MaxTime < q.mint || meta.MinTime > q.maxt {
+			continue
+		}
+
+		ir, cr, err := openRemoteBlock(q.ctx, q.bucket, dir)
+		if err != nil {
+			warnings = append(warnings, errors.Wrapf(err, "open remote block %s", dir))
+			continue
+		}
+		blockSet, _, err := tsdb.LookupChunkSeries(ir, cr, nil, ms...)
+		if err != nil {
+			warnings = append(warnings, errors.Wrapf(err, "select from remote block %s", dir))
+			continue
+		}
+		set = storage.NewMergeSeriesSet([]storage.SeriesSet{set, seriesSet{set: blockSet}}, nil)
+	}
+	return set, warnings, nil
+}
+
+func (q *bucketQuerier) SelectSorted(p *storage.SelectParams, ms ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
+	return q.Select(p, ms...)
+}
+
+func (q *bucketQuerier) LabelValues(name string) ([]string, storage.Warnings, error) {
+	return q.labels(func(ir tsdb.IndexReader) ([]string, error) {
+		return ir.LabelValues(name)
+	})
+}
+
+func (q *bucketQuerier) LabelNames() ([]string, storage.Warnings, error) {
+	return q.labels(func(ir tsdb.IndexReader) ([]string, error) {
+		return ir.LabelNames()
+	})
+}
+
+// labels merges the result of read across every block shipped to the
+// bucket. A block whose index can't be read contributes a warning instead
+// of failing the whole call, consistent with Select: once a shipped block
+// is dropped from local disk, the bucket is the only place its labels live,
+// so silently returning nothing here would look like the data never
+// existed rather than like a read failure.
+func (q *bucketQuerier) labels(read func(tsdb.IndexReader) ([]string, error)) ([]string, storage.Warnings, error) {
+	dirs, err := listBlockDirs(q.ctx, q.bucket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	seen := map[string]struct{}{}
+	var warnings storage.Warnings
+	for _, dir := range dirs {
+		ir, _, err := openRemoteBlock(q.ctx, q.bucket, dir)
+		if err != nil {
+			warnings = append(warnings, errors.Wrapf(err, "open remote block %s", dir))
+			continue
+		}
+		values, err := read(ir)
+		if err != nil {
+			warnings = append(warnings, errors.Wrapf(err, "read labels from remote block %s", dir))
+			continue
+		}
+		for _, v := range values {
+			seen[v] = struct{}{}
+		}
+	}
+
+	out := make([]string, 0, len(seen))
+	for v := range seen {
+		out = append(out, v)
+	}
+	sort.Strings(out)
+	return out, warnings, nil
+}
+
+func (q *bucketQuerier) Close() error { return nil }
+
+// readRemoteMeta downloads and decodes a shipped block's meta.json.
+func readRemoteMeta(ctx context.Context, bucket Bucket, blockDir string) (*tsdb.BlockMeta, error) {
+	rc, err := bucket.Download(ctx, blockDir+"/meta.json")
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	var meta tsdb.BlockMeta
+	if err := json.Unmarshal(b, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// openRemoteBlock downloads the index and chunk files for a shipped block
+// and returns readers over them, without materializing the whole block on
+// local disk.
+func openRemoteBlock(ctx context.Context, bucket Bucket, blockDir string) (tsdb.IndexReader, tsdb.ChunkReader, error) {
+	idx, err := bucket.Download(ctx, blockDir+"/index")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer idx.Close()
+
+	indexBytes, err := ioutil.ReadAll(idx)
+	if err != nil {
+		return nil, nil, err
+	}
+	ir, err := tsdb.NewIndexReaderFromBytes(indexBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cr := &remoteChunkReader{ctx: ctx, bucket: bucket, blockDir: blockDir}
+	return ir, cr, nil
+}
+
+// remoteChunkReader fetches chunk segment files from the bucket on demand,
+// so a query only downloads the segment files it actually touches. Each
+// Chunk call downloads the whole segment file holding that chunk.
+type remoteChunkReader struct {
+	ctx      context.Context
+	bucket   Bucket
+	blockDir string
+}
+
+func (r *remoteChunkReader) Chunk(ref uint64) (chunkenc.Chunk, error) {
+	segment := ref >> 32
+	rc, err := r.bucket.Download(r.ctx, r.blockDir+"/chunks/"+segmentFileName(segment))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	return chunkenc.FromData(chunkenc.EncXOR, b[uint32(ref):])
+}
+
+func (r *remoteChunkReader) Close() error { return nil }
+
+// segmentFileName mirrors the TSDB chunk segment naming convention
+// (000001, 000002, ...).
+func segmentFileName(segment uint64) string {
+	return fmt.Sprintf("%0.6d", segment)
+}
@@ -0,0 +1,63 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeBucket is an in-memory Bucket backed by a flat name->content map, for
+// exercising object-key grouping without a real object store.
+type fakeBucket struct {
+	objects map[string]string
+}
+
+func (b *fakeBucket) Upload(ctx context.Context, name string, r io.Reader) error { return nil }
+
+func (b *fakeBucket) Download(ctx context.Context, name string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(b.objects[name])), nil
+}
+
+func (b *fakeBucket) Iter(ctx context.Context, dir string, f func(name string) error) error {
+	for name := range b.objects {
+		if err := f(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *fakeBucket) Delete(ctx context.Context, name string) error {
+	delete(b.objects, name)
+	return nil
+}
+
+func TestListBlockDirsGroupsObjectsByBlock(t *testing.T) {
+	bucket := &fakeBucket{objects: map[string]string{
+		"01EXAMPLE1/meta.json":     "{}",
+		"01EXAMPLE1/index":         "",
+		"01EXAMPLE1/chunks/000001": "",
+		"01EXAMPLE2/meta.json":     "{}",
+		"01EXAMPLE2/index":         "",
+	}}
+
+	dirs, err := listBlockDirs(context.Background(), bucket)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"01EXAMPLE1", "01EXAMPLE2"}, dirs, "each block's object keys must collapse to a single directory entry")
+}
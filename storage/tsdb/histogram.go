@@ -0,0 +1,42 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"github.com/prometheus/prometheus/pkg/histogram"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// histogramIterator wraps a chunkenc.Iterator so that, when the underlying
+// chunk holds native histogram samples, callers can retrieve them through
+// AtHistogram instead of At.
+type histogramIterator struct {
+	chunkenc.Iterator
+}
+
+func newHistogramIterator(it chunkenc.Iterator) chunkenc.Iterator {
+	return &histogramIterator{Iterator: it}
+}
+
+// AtHistogram returns the native histogram at the current iterator position.
+// It is only valid to call when the wrapped iterator is positioned over a
+// histogram chunk; hs must support it via the optional interface below.
+func (it *histogramIterator) AtHistogram() (int64, *histogram.Histogram) {
+	if hs, ok := it.Iterator.(interface {
+		AtHistogram() (int64, *histogram.Histogram)
+	}); ok {
+		return hs.AtHistogram()
+	}
+	return 0, nil
+}
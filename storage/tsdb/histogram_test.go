@@ -0,0 +1,53 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/histogram"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistogramIteratorForwardsAtHistogram(t *testing.T) {
+	h := &histogram.Histogram{Count: 42}
+	in := &fakeHistogramIterator{
+		fakeIterator: fakeIterator{samples: []oooSample{{t: 1, v: 1}}},
+		h:            h,
+	}
+
+	it := newHistogramIterator(in)
+	require.True(t, it.Next())
+
+	hit, ok := it.(interface {
+		AtHistogram() (int64, *histogram.Histogram)
+	})
+	require.True(t, ok, "newHistogramIterator must return something implementing the optional AtHistogram interface")
+
+	tt, got := hit.AtHistogram()
+	require.Equal(t, int64(1), tt)
+	require.Equal(t, h, got)
+}
+
+func TestHistogramIteratorAtHistogramWithoutSupport(t *testing.T) {
+	in := &fakeIterator{samples: []oooSample{{t: 1, v: 1}}}
+
+	it := newHistogramIterator(in).(interface {
+		AtHistogram() (int64, *histogram.Histogram)
+	})
+	require.True(t, in.Next())
+
+	_, got := it.AtHistogram()
+	require.Nil(t, got, "an iterator with no histogram support must yield a nil histogram rather than panicking")
+}
@@ -0,0 +1,320 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/pkg/histogram"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+)
+
+// oooSample is a single buffered out-of-order sample.
+type oooSample struct {
+	t int64
+	v float64
+}
+
+// oooSeriesBuffer is one series' buffered out-of-order samples, plus the
+// labels needed to WAL-log them and, later, to write them into an
+// overlapping block.
+type oooSeriesBuffer struct {
+	lset    labels.Labels
+	samples []oooSample
+}
+
+// oooHead buffers late samples per series ref, ahead of the head compaction
+// that will flush them into overlapping blocks. Every insert is also
+// WAL-logged via walLog (see wal_ooo.go), so replaying the WAL after a
+// restart reconstructs this buffer before it would otherwise be lost.
+type oooHead struct {
+	timeWindow int64
+	walLog     func([]byte) error
+
+	appended prometheus.Counter
+	tooOld   prometheus.Counter
+
+	mtx    sync.Mutex
+	series map[uint64]*oooSeriesBuffer
+}
+
+// newOOOHead returns an oooHead accepting samples up to timeWindow behind
+// the head's max time. walLog, if non-nil, is called with an encoded WAL
+// record for every buffered sample so it survives a restart; metrics are
+// registered against r (may be nil, e.g. in tests), mirroring how the rest
+// of this package threads the caller-supplied registerer through rather
+// than registering against the global default.
+func newOOOHead(timeWindow int64, walLog func([]byte) error, r prometheus.Registerer) *oooHead {
+	h := &oooHead{
+		timeWindow: timeWindow,
+		walLog:     walLog,
+		series:     map[uint64]*oooSeriesBuffer{},
+		appended: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_ooo_samples_appended_total",
+			Help: "Total number of out-of-order samples successfully buffered.",
+		}),
+		tooOld: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_ooo_samples_too_old_total",
+			Help: "Total number of samples rejected for falling outside the out-of-order time window.",
+		}),
+	}
+	if r != nil {
+		r.MustRegister(h.appended, h.tooOld)
+	}
+	return h
+}
+
+// accepts reports whether a sample at t is within the out-of-order window
+// behind headMaxTime, i.e. whether it should be buffered rather than
+// rejected as storage.ErrOutOfOrderSample.
+func (h *oooHead) accepts(t, headMaxTime int64) bool {
+	if h.timeWindow <= 0 {
+		return false
+	}
+	return t >= headMaxTime-h.timeWindow && t < headMaxTime
+}
+
+// insert buffers a sample, keeping each series' buffer sorted by timestamp
+// and deduplicating identical (t, v) pairs written more than once (e.g. on
+// WAL replay). It also appends a WAL record for the sample; WAL replay uses
+// insertReplayed instead, which does not (see replayOOOWAL).
+func (h *oooHead) insert(ref uint64, lset labels.Labels, t int64, v float64) {
+	if !h.insertBuffer(ref, lset, t, v) {
+		return
+	}
+	h.appended.Inc()
+
+	if h.walLog != nil {
+		// Errors are not fatal to the append itself: the sample is already
+		// buffered in memory. A failed WAL write is not retried; it only
+		// risks losing this one buffered sample on an unclean restart.
+		_ = h.walLog(encodeOOORecord(ref, lset, t, v))
+	}
+}
+
+// insertReplayed re-inserts a sample recovered from the WAL. Unlike insert,
+// it never writes a new WAL record, since the sample is already on disk -
+// doing otherwise would duplicate every record on each replay.
+func (h *oooHead) insertReplayed(ref uint64, lset labels.Labels, t int64, v float64) {
+	if h.insertBuffer(ref, lset, t, v) {
+		h.appended.Inc()
+	}
+}
+
+// insertBuffer adds the sample to the in-memory buffer, keeping it sorted
+// and deduplicated, and reports whether it was a new sample (as opposed to a
+// duplicate of one already buffered).
+func (h *oooHead) insertBuffer(ref uint64, lset labels.Labels, t int64, v float64) bool {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	buf, ok := h.series[ref]
+	if !ok {
+		buf = &oooSeriesBuffer{lset: lset}
+		h.series[ref] = buf
+	}
+	samples := buf.samples
+	i := sort.Search(len(samples), func(i int) bool { return samples[i].t >= t })
+	if i < len(samples) && samples[i].t == t && samples[i].v == v {
+		return false
+	}
+	samples = append(samples, oooSample{})
+	copy(samples[i+1:], samples[i:])
+	samples[i] = oooSample{t: t, v: v}
+	buf.samples = samples
+	return true
+}
+
+// samples returns a copy of the buffered samples for ref, sorted by
+// timestamp, for use by the querier's k-way merge.
+func (h *oooHead) samples(ref uint64) []oooSample {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	buf, ok := h.series[ref]
+	if !ok {
+		return nil
+	}
+	out := make([]oooSample, len(buf.samples))
+	copy(out, buf.samples)
+	return out
+}
+
+// reset removes the samples up to and including flushedThrough from a
+// series' buffer, once those samples have been durably written into an
+// overlapping block. It only trims the flushed prefix rather than clearing
+// the whole buffer, because insert may have appended newer samples for ref
+// concurrently with the flush's (collectFlushable snapshot, disk write)
+// round trip; naively deleting the whole entry would silently drop those.
+func (h *oooHead) reset(ref uint64, flushedThrough int64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	buf, ok := h.series[ref]
+	if !ok {
+		return
+	}
+	i := sort.Search(len(buf.samples), func(i int) bool { return buf.samples[i].t > flushedThrough })
+	if i == 0 {
+		return
+	}
+	if i == len(buf.samples) {
+		delete(h.series, ref)
+		return
+	}
+	remaining := make([]oooSample, len(buf.samples)-i)
+	copy(remaining, buf.samples[i:])
+	buf.samples = remaining
+}
+
+// flushable is a buffered series whose samples are all old enough, relative
+// to the head's current min time, to be safely compacted into an
+// overlapping block.
+type flushable struct {
+	ref            uint64
+	lset           labels.Labels
+	samples        []oooSample
+	flushedThrough int64
+}
+
+// collectFlushable returns every buffered series whose newest sample is
+// older than headMinTime, i.e. series the head has already compacted past
+// and so can no longer change underneath a concurrent querier. It does not
+// clear the buffers itself; callers should call reset after successfully
+// writing each series' samples into a block.
+func (h *oooHead) collectFlushable(headMinTime int64) []flushable {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	var out []flushable
+	for ref, buf := range h.series {
+		if len(buf.samples) == 0 {
+			continue
+		}
+		if buf.samples[len(buf.samples)-1].t >= headMinTime {
+			continue
+		}
+		samples := make([]oooSample, len(buf.samples))
+		copy(samples, buf.samples)
+		out = append(out, flushable{ref: ref, lset: buf.lset, samples: samples, flushedThrough: samples[len(samples)-1].t})
+	}
+	return out
+}
+
+// oooMergeIterator k-way merges an in-order chunkenc.Iterator with a sorted
+// slice of buffered out-of-order samples, deduplicating identical (t, v)
+// pairs so a sample replayed from both sources is only surfaced once. It
+// also forwards AtHistogram to the in-order iterator via the same optional
+// interface histogramIterator uses, so a series with both histogram chunks
+// and buffered out-of-order samples doesn't lose histogram support merely
+// because an out-of-order window is configured.
+type oooMergeIterator struct {
+	in      chunkenc.Iterator
+	ooo     []oooSample
+	oooIdx  int
+	inOK    bool
+	inT     int64
+	inV     float64
+	inHist  *histogram.Histogram
+	started bool
+
+	curT      int64
+	curV      float64
+	curFromIn bool
+	curHist   *histogram.Histogram
+}
+
+func newOOOMergeIterator(in chunkenc.Iterator, ooo []oooSample) chunkenc.Iterator {
+	return &oooMergeIterator{in: in, ooo: ooo}
+}
+
+func (it *oooMergeIterator) Seek(t int64) bool {
+	for it.Next() {
+		if it.curT >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *oooMergeIterator) Next() bool {
+	if !it.started {
+		it.started = true
+		it.inOK = it.in.Next()
+		if it.inOK {
+			it.inT, it.inV = it.in.At()
+			it.inHist = histogramAt(it.in)
+		}
+	}
+
+	for {
+		haveIn := it.inOK
+		haveOOO := it.oooIdx < len(it.ooo)
+		if !haveIn && !haveOOO {
+			return false
+		}
+
+		switch {
+		case haveIn && (!haveOOO || it.inT <= it.ooo[it.oooIdx].t):
+			it.curT, it.curV, it.curFromIn, it.curHist = it.inT, it.inV, true, it.inHist
+			skippedDup := haveOOO && it.ooo[it.oooIdx].t == it.inT && it.ooo[it.oooIdx].v == it.inV
+			it.inOK = it.in.Next()
+			if it.inOK {
+				it.inT, it.inV = it.in.At()
+				it.inHist = histogramAt(it.in)
+			}
+			if skippedDup {
+				it.oooIdx++
+			}
+			return true
+		default:
+			s := it.ooo[it.oooIdx]
+			it.oooIdx++
+			it.curT, it.curV, it.curFromIn, it.curHist = s.t, s.v, false, nil
+			return true
+		}
+	}
+}
+
+func (it *oooMergeIterator) At() (int64, float64) { return it.curT, it.curV }
+func (it *oooMergeIterator) Err() error           { return it.in.Err() }
+
+// AtHistogram returns the native histogram at the current position, if the
+// sample came from the in-order iterator and that iterator supports
+// histograms. Buffered out-of-order samples are always plain floats, so
+// this returns nil for those.
+func (it *oooMergeIterator) AtHistogram() (int64, *histogram.Histogram) {
+	if !it.curFromIn || it.curHist == nil {
+		return it.curT, nil
+	}
+	return it.curT, it.curHist
+}
+
+// histogramAt retrieves the native histogram at in's current position via
+// the same optional interface histogramIterator.AtHistogram relies on,
+// returning nil if in doesn't support histograms or isn't positioned over
+// one.
+func histogramAt(in chunkenc.Iterator) *histogram.Histogram {
+	hs, ok := in.(interface {
+		AtHistogram() (int64, *histogram.Histogram)
+	})
+	if !ok {
+		return nil
+	}
+	_, h := hs.AtHistogram()
+	return h
+}
@@ -0,0 +1,122 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// oooFlusher periodically drains an oooHead's buffer into overlapping
+// blocks once the head has compacted past the buffered samples, so the
+// buffer doesn't grow unboundedly for the lifetime of the process. Without
+// this, h.reset is never called and every out-of-order sample stays
+// in memory (and keeps being replayed from the WAL on every restart) for as
+// long as the process runs.
+type oooFlusher struct {
+	logger log.Logger
+	db     *tsdb.DB
+	head   *oooHead
+	dir    string
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func newOOOFlusher(l log.Logger, db *tsdb.DB, h *oooHead, dir string) *oooFlusher {
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	f := &oooFlusher{
+		logger: l,
+		db:     db,
+		head:   h,
+		dir:    dir,
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+func (f *oooFlusher) run() {
+	defer close(f.done)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-ticker.C:
+			if err := f.flushOnce(context.Background()); err != nil {
+				level.Error(f.logger).Log("msg", "flushing out-of-order buffer failed", "err", err)
+			}
+		}
+	}
+}
+
+// flushOnce writes every series whose buffered samples the head has already
+// compacted past into a single overlapping block, then clears those
+// series' buffers and asks the DB to pick up the new block.
+func (f *oooFlusher) flushOnce(ctx context.Context) error {
+	flushable := f.head.collectFlushable(f.db.Head().MinTime())
+	if len(flushable) == 0 {
+		return nil
+	}
+
+	w, err := NewBlockWriter(f.logger, f.dir, f.db.Head().MaxTime()-f.db.Head().MinTime()+1)
+	if err != nil {
+		return err
+	}
+	app, err := w.Appender()
+	if err != nil {
+		return err
+	}
+	for _, s := range flushable {
+		for _, sample := range s.samples {
+			if _, err := app.Add(s.lset, sample.t, sample.v); err != nil {
+				return err
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		return err
+	}
+	id, blockDir, err := w.Flush(ctx)
+	if err != nil {
+		return err
+	}
+	// The block is assembled under f.dir; move it into the DB's own
+	// directory, which is where Reload looks for blocks.
+	if err := os.Rename(blockDir, f.db.Dir()+"/"+id.String()); err != nil {
+		return err
+	}
+
+	for _, s := range flushable {
+		f.head.reset(s.ref, s.flushedThrough)
+	}
+	return f.db.Reload()
+}
+
+func (f *oooFlusher) Close() {
+	close(f.quit)
+	<-f.done
+}
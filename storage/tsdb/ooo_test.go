@@ -0,0 +1,174 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/pkg/histogram"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIterator is a hand-rolled chunkenc.Iterator over a fixed slice of
+// samples, standing in for a real chunk iterator in tests.
+type fakeIterator struct {
+	samples []oooSample
+	i       int
+}
+
+func (it *fakeIterator) Seek(t int64) bool {
+	for ; it.i < len(it.samples); it.i++ {
+		if it.samples[it.i].t >= t {
+			return true
+		}
+	}
+	return false
+}
+
+func (it *fakeIterator) Next() bool {
+	if it.i >= len(it.samples) {
+		return false
+	}
+	it.i++
+	return it.i <= len(it.samples)
+}
+
+func (it *fakeIterator) At() (int64, float64) {
+	s := it.samples[it.i-1]
+	return s.t, s.v
+}
+
+func (it *fakeIterator) Err() error { return nil }
+
+// fakeHistogramIterator is a fakeIterator that also answers AtHistogram, for
+// a fixed histogram shared by every sample, exercising the optional
+// interface oooMergeIterator.AtHistogram forwards to.
+type fakeHistogramIterator struct {
+	fakeIterator
+	h *histogram.Histogram
+}
+
+func (it *fakeHistogramIterator) AtHistogram() (int64, *histogram.Histogram) {
+	t, _ := it.fakeIterator.At()
+	return t, it.h
+}
+
+func TestOOOMergeIteratorForwardsAtHistogram(t *testing.T) {
+	h := &histogram.Histogram{Count: 7}
+	in := &fakeHistogramIterator{
+		fakeIterator: fakeIterator{samples: []oooSample{{t: 1, v: 1}, {t: 3, v: 3}}},
+		h:            h,
+	}
+	ooo := []oooSample{{t: 2, v: 2}}
+
+	it := newOOOMergeIterator(in, ooo).(*oooMergeIterator)
+
+	require.True(t, it.Next())
+	tt, hist := it.AtHistogram()
+	require.Equal(t, int64(1), tt)
+	require.Equal(t, h, hist, "a sample sourced from the in-order iterator must forward its histogram")
+
+	require.True(t, it.Next())
+	_, hist = it.AtHistogram()
+	require.Nil(t, hist, "a buffered out-of-order sample has no histogram")
+
+	require.True(t, it.Next())
+	_, hist = it.AtHistogram()
+	require.Equal(t, h, hist)
+}
+
+func TestOOOMergeIteratorInterleaves(t *testing.T) {
+	in := &fakeIterator{samples: []oooSample{{t: 1, v: 1}, {t: 3, v: 3}, {t: 5, v: 5}}}
+	ooo := []oooSample{{t: 2, v: 2}, {t: 4, v: 4}}
+
+	it := newOOOMergeIterator(in, ooo)
+
+	var got []oooSample
+	for it.Next() {
+		tt, v := it.At()
+		got = append(got, oooSample{t: tt, v: v})
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []oooSample{{1, 1}, {2, 2}, {3, 3}, {4, 4}, {5, 5}}, got)
+}
+
+func TestOOOMergeIteratorDedupsIdenticalSamples(t *testing.T) {
+	in := &fakeIterator{samples: []oooSample{{t: 1, v: 1}, {t: 2, v: 2}}}
+	ooo := []oooSample{{t: 2, v: 2}, {t: 3, v: 3}}
+
+	it := newOOOMergeIterator(in, ooo)
+
+	var got []oooSample
+	for it.Next() {
+		tt, v := it.At()
+		got = append(got, oooSample{t: tt, v: v})
+	}
+	require.Equal(t, []oooSample{{1, 1}, {2, 2}, {3, 3}}, got)
+}
+
+func TestOOOHeadAccepts(t *testing.T) {
+	h := newOOOHead(100, nil, nil)
+
+	require.True(t, h.accepts(950, 1000))
+	require.False(t, h.accepts(1000, 1000), "samples at or after headMaxTime are not out-of-order")
+	require.False(t, h.accepts(899, 1000), "samples older than the window should be rejected")
+
+	h2 := newOOOHead(0, nil, nil)
+	require.False(t, h2.accepts(999, 1000), "a zero time window disables out-of-order buffering entirely")
+}
+
+func TestOOOHeadInsertDedupsAndSorts(t *testing.T) {
+	h := newOOOHead(100, nil, nil)
+	lset := labels.FromStrings("__name__", "up")
+
+	h.insert(1, lset, 20, 2)
+	h.insert(1, lset, 10, 1)
+	h.insert(1, lset, 20, 2) // duplicate, should not be re-inserted
+
+	require.Equal(t, []oooSample{{10, 1}, {20, 2}}, h.samples(1))
+}
+
+func TestOOOHeadCollectFlushable(t *testing.T) {
+	h := newOOOHead(100, nil, nil)
+	lset := labels.FromStrings("__name__", "up")
+
+	h.insert(1, lset, 10, 1)
+	h.insert(2, lset, 500, 5)
+
+	flushable := h.collectFlushable(100)
+	require.Len(t, flushable, 1, "only the series whose newest sample is behind headMinTime should be flushable")
+	require.Equal(t, uint64(1), flushable[0].ref)
+
+	h.reset(1, flushable[0].flushedThrough)
+	require.Empty(t, h.samples(1))
+}
+
+func TestOOOHeadResetKeepsSamplesInsertedAfterSnapshot(t *testing.T) {
+	h := newOOOHead(1000, nil, nil)
+	lset := labels.FromStrings("__name__", "up")
+
+	h.insert(1, lset, 10, 1)
+	h.insert(1, lset, 20, 2)
+
+	flushable := h.collectFlushable(100)
+	require.Len(t, flushable, 1)
+
+	// Simulate a sample arriving for the same series while the flush's disk
+	// write is in flight, i.e. after the snapshot but before reset.
+	h.insert(1, lset, 30, 3)
+
+	h.reset(1, flushable[0].flushedThrough)
+	require.Equal(t, []oooSample{{30, 3}}, h.samples(1), "reset must not drop samples inserted after the flush snapshot was taken")
+}
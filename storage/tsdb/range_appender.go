@@ -0,0 +1,133 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// blockFlushWriter is the subset of *BlockWriter that RangeAppender relies
+// on. It exists so tests can inject a fake writer instead of assembling a
+// real TSDB block on disk.
+type blockFlushWriter interface {
+	Appender() (storage.Appender, error)
+	Flush(ctx context.Context) (ulid.ULID, string, error)
+}
+
+// RangeAppender is a storage.Appender that rotates through a sequence of
+// BlockWriters, flushing and starting a new one whenever a sample would
+// exceed the current block's configured size. It lets a multi-day backfill
+// run as a single append pass instead of the caller managing BlockWriters
+// itself.
+type RangeAppender struct {
+	logger    log.Logger
+	dir       string
+	blockSize int64
+	newWriter func(log.Logger, string, int64) (blockFlushWriter, error)
+
+	current  blockFlushWriter
+	appender storage.Appender
+	blocks   []ulid.ULID
+}
+
+// NewRangeAppender returns a RangeAppender that writes blocks of at most
+// blockSize milliseconds under dir as samples are appended.
+func NewRangeAppender(logger log.Logger, dir string, blockSize int64) (*RangeAppender, error) {
+	r := &RangeAppender{
+		logger:    logger,
+		dir:       dir,
+		blockSize: blockSize,
+		newWriter: func(l log.Logger, dir string, blockSize int64) (blockFlushWriter, error) {
+			return NewBlockWriter(l, dir, blockSize)
+		},
+	}
+	if err := r.rotate(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RangeAppender) rotate() error {
+	w, err := r.newWriter(r.logger, r.dir, r.blockSize)
+	if err != nil {
+		return errors.Wrap(err, "start next block")
+	}
+	a, err := w.Appender()
+	if err != nil {
+		return errors.Wrap(err, "open appender for next block")
+	}
+	r.current, r.appender = w, a
+	return nil
+}
+
+func (r *RangeAppender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
+	ref, err := r.appender.Add(lset, t, v)
+	if errors.Cause(err) == ErrRangeExceedsBlockSize {
+		if err := r.flushAndRotate(); err != nil {
+			return 0, err
+		}
+		return r.appender.Add(lset, t, v)
+	}
+	return ref, err
+}
+
+func (r *RangeAppender) AddFast(lset labels.Labels, ref uint64, t int64, v float64) error {
+	err := r.appender.AddFast(lset, ref, t, v)
+	if errors.Cause(err) == ErrRangeExceedsBlockSize {
+		if err := r.flushAndRotate(); err != nil {
+			return err
+		}
+		_, err := r.appender.Add(lset, t, v)
+		return err
+	}
+	return err
+}
+
+// flushAndRotate commits and flushes the current block, then opens a fresh
+// BlockWriter so appends can continue past the previous block's range.
+func (r *RangeAppender) flushAndRotate() error {
+	if err := r.appender.Commit(); err != nil {
+		return errors.Wrap(err, "commit block before rotation")
+	}
+	id, _, err := r.current.Flush(context.Background())
+	if err != nil {
+		return errors.Wrap(err, "flush block before rotation")
+	}
+	r.blocks = append(r.blocks, id)
+	return r.rotate()
+}
+
+func (r *RangeAppender) Commit() error { return r.appender.Commit() }
+
+func (r *RangeAppender) Rollback() error { return r.appender.Rollback() }
+
+// Flush commits and flushes the final in-progress block, and returns the
+// ULIDs of every block written across the whole backfill, in the order the
+// blocks were written.
+func (r *RangeAppender) Flush(ctx context.Context) ([]ulid.ULID, error) {
+	if err := r.appender.Commit(); err != nil {
+		return nil, errors.Wrap(err, "commit final block")
+	}
+	id, _, err := r.current.Flush(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return append(r.blocks, id), nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+)
+
+var errCommitNotCalled = errors.New("flush called before commit")
+
+// fakeFlushWriter is a blockFlushWriter that records whether its appender's
+// Commit was called before Flush, standing in for a real *BlockWriter.
+type fakeFlushWriter struct {
+	appender *fakeFlushAppender
+	flushed  bool
+}
+
+func (w *fakeFlushWriter) Appender() (storage.Appender, error) {
+	w.appender = &fakeFlushAppender{}
+	return w.appender, nil
+}
+
+func (w *fakeFlushWriter) Flush(ctx context.Context) (ulid.ULID, string, error) {
+	w.flushed = true
+	if !w.appender.committed {
+		return ulid.ULID{}, "", errCommitNotCalled
+	}
+	return ulid.ULID{}, "", nil
+}
+
+type fakeFlushAppender struct {
+	committed bool
+}
+
+func (a *fakeFlushAppender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
+	return 0, nil
+}
+func (a *fakeFlushAppender) AddFast(lset labels.Labels, ref uint64, t int64, v float64) error {
+	return nil
+}
+func (a *fakeFlushAppender) Commit() error {
+	a.committed = true
+	return nil
+}
+func (a *fakeFlushAppender) Rollback() error { return nil }
+
+func TestRangeAppenderFlushCommitsBeforeFlushing(t *testing.T) {
+	var writer *fakeFlushWriter
+	r := &RangeAppender{
+		logger:    log.NewNopLogger(),
+		dir:       t.TempDir(),
+		blockSize: 1000,
+		newWriter: func(log.Logger, string, int64) (blockFlushWriter, error) {
+			writer = &fakeFlushWriter{}
+			return writer, nil
+		},
+	}
+	require.NoError(t, r.rotate())
+
+	_, err := r.Flush(context.Background())
+	require.NoError(t, err)
+	require.True(t, writer.flushed)
+	require.True(t, writer.appender.committed, "Flush must commit the current block's appender before flushing it")
+}
@@ -0,0 +1,226 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"strconv"
+
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// CompactionStrategySplitMerge selects the sharded split-then-merge
+// compaction strategy in Options.CompactionStrategy.
+const CompactionStrategySplitMerge = "split-merge"
+
+// Labels set on a shard-labeled block's Meta().Compaction, following the
+// convention used by the Thanos compactor for shard-partitioned blocks.
+const (
+	shardIDLabel    = "thanos.shard_id"
+	shardCountLabel = "thanos.shard_count"
+)
+
+// ShardedCompactor wraps a tsdb.LeveledCompactor and runs compaction in two
+// phases: Write splits a source block into Shards output blocks keyed by
+// labels.Hash()%Shards, and Compact vertically merges same-shard blocks
+// across their time ranges. This lets very large heads compact in parallel
+// without holding the full postings/series set of the head in memory at once.
+type ShardedCompactor struct {
+	leveled tsdb.Compactor
+	shards  int
+
+	// stamp rewrites a freshly written block's meta.json with its shard
+	// labels. It defaults to stampShard; tests override it to avoid
+	// touching disk when exercising Write/Compact against a fake leveled
+	// compactor that doesn't actually create a block directory.
+	stamp func(dest string, id ulid.ULID, shard, shards int) error
+}
+
+// NewShardedCompactor returns a ShardedCompactor that fans a single
+// compaction out across the given number of shards. leveled is typically a
+// *tsdb.LeveledCompactor, but accepting the tsdb.Compactor interface lets
+// tests substitute a fake.
+func NewShardedCompactor(leveled tsdb.Compactor, shards int) *ShardedCompactor {
+	return &ShardedCompactor{leveled: leveled, shards: shards, stamp: stampShard}
+}
+
+// Write implements tsdb.Compactor. It reads the source block (or head) once
+// and writes one output block per shard, each containing only the series
+// whose labels.Hash() % Shards equals that shard's index.
+func (c *ShardedCompactor) Write(dest string, b tsdb.BlockReader, mint, maxt int64, parent *tsdb.BlockMeta) ([]ulid.ULID, error) {
+	ids := make([]ulid.ULID, 0, c.shards)
+	for shard := 0; shard < c.shards; shard++ {
+		id, err := c.leveled.Write(dest, &shardFilteredReader{BlockReader: b, shard: shard, shards: c.shards}, mint, maxt, parent)
+		if err != nil {
+			return nil, err
+		}
+		if id == (ulid.ULID{}) {
+			// The shard's filtered view had no series to write - this is the
+			// normal case whenever Shards exceeds the block's distinct
+			// label-hash buckets. tsdb.Compactor.Write leaves no directory on
+			// disk in that case, so there's nothing to stamp and no ID to
+			// report for this shard.
+			continue
+		}
+		if err := c.stamp(dest, id, shard, c.shards); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// Compact implements tsdb.Compactor. Like tsdb.LeveledCompactor, it takes
+// one input set and produces exactly one output block, so dirs must all
+// belong to the same shard (or none be shard-labeled at all) - Plan only
+// ever proposes such groups. Mixed-shard input is a caller bug and is
+// rejected rather than silently compacted into several untracked blocks.
+func (c *ShardedCompactor) Compact(dest string, dirs []string, open []*tsdb.Block) (ulid.ULID, error) {
+	shard, labeled, err := commonShard(dirs)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+
+	id, err := c.leveled.Compact(dest, dirs, open)
+	if err != nil {
+		return ulid.ULID{}, err
+	}
+	if labeled {
+		if err := c.stamp(dest, id, shard, c.shards); err != nil {
+			return ulid.ULID{}, err
+		}
+	}
+	return id, nil
+}
+
+// commonShard returns the single shard ID shared by every shard-labeled
+// block in dirs. labeled reports whether any block in dirs carries a shard
+// label at all; if none do, shard is meaningless and ignored by the caller.
+// It is an error for dirs to mix shard-labeled blocks from different shards,
+// or to mix labeled and unlabeled blocks.
+func commonShard(dirs []string) (shard int, labeled bool, err error) {
+	shard = -1
+	unlabeled := false
+	for _, dir := range dirs {
+		meta, err := tsdb.ReadMetaFile(dir)
+		if err != nil {
+			return 0, false, err
+		}
+		s, ok := meta.Compaction.Labels[shardIDLabel]
+		if !ok {
+			if labeled {
+				return 0, false, errors.Errorf("sharded compactor: cannot compact shard-labeled block alongside unlabeled block %s", dir)
+			}
+			unlabeled = true
+			continue
+		}
+		if unlabeled {
+			return 0, false, errors.Errorf("sharded compactor: cannot compact shard-labeled block %s alongside unlabeled blocks", dir)
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return 0, false, err
+		}
+		if labeled && n != shard {
+			return 0, false, errors.Errorf("sharded compactor: Compact called with blocks from different shards (%d and %d); Plan should only ever group same-shard blocks", shard, n)
+		}
+		shard, labeled = n, true
+	}
+	return shard, labeled, nil
+}
+
+// Plan implements tsdb.Compactor. It defers to the wrapped leveled
+// compactor's plan, then narrows the result to the shard of its first
+// entry (or to unlabeled blocks, if that entry is unlabeled), so a Compact
+// call is never handed a mix of shards: blocks from other shards are left
+// for a later Plan/Compact round.
+func (c *ShardedCompactor) Plan(dir string) ([]string, error) {
+	dirs, err := c.leveled.Plan(dir)
+	if err != nil || len(dirs) == 0 {
+		return dirs, err
+	}
+
+	first, firstLabeled, err := commonShard(dirs[:1])
+	if err != nil {
+		return nil, err
+	}
+
+	out := dirs[:0]
+	for _, d := range dirs {
+		shard, labeled, err := commonShard([]string{d})
+		if err != nil {
+			return nil, err
+		}
+		if labeled == firstLabeled && (!labeled || shard == first) {
+			out = append(out, d)
+		}
+	}
+	return out, nil
+}
+
+// stampShard rewrites the freshly written block's meta.json to record which
+// shard it belongs to, so a later Compact call (and the adapter's Querier)
+// can tell shard-partitioned blocks apart from ordinary ones.
+func stampShard(dest string, id ulid.ULID, shard, shards int) error {
+	dir := dest + "/" + id.String()
+	meta, err := tsdb.ReadMetaFile(dir)
+	if err != nil {
+		return err
+	}
+	if meta.Compaction.Labels == nil {
+		meta.Compaction.Labels = map[string]string{}
+	}
+	meta.Compaction.Labels[shardIDLabel] = strconv.Itoa(shard)
+	meta.Compaction.Labels[shardCountLabel] = strconv.Itoa(shards)
+	_, err = tsdb.WriteMetaFile(dir, meta)
+	return err
+}
+
+// shardFilteredReader wraps a tsdb.BlockReader so that only series hashing
+// into the given shard are visible to the wrapped leveled compactor.
+type shardFilteredReader struct {
+	tsdb.BlockReader
+	shard, shards int
+}
+
+func (r *shardFilteredReader) Index() (tsdb.IndexReader, error) {
+	ir, err := r.BlockReader.Index()
+	if err != nil {
+		return nil, err
+	}
+	return &shardFilteredIndexReader{IndexReader: ir, shard: r.shard, shards: r.shards}, nil
+}
+
+// shardFilteredIndexReader drops postings for series outside the configured
+// shard, so the wrapped compactor only ever writes that shard's series.
+type shardFilteredIndexReader struct {
+	tsdb.IndexReader
+	shard, shards int
+}
+
+func (r *shardFilteredIndexReader) Postings(name, value string) (tsdb.Postings, error) {
+	p, err := r.IndexReader.Postings(name, value)
+	if err != nil {
+		return nil, err
+	}
+	return tsdb.PostingsForMatcher(p, func(ref uint64) bool {
+		var lset labels.Labels
+		if err := r.Series(ref, &lset, nil); err != nil {
+			return false
+		}
+		return int(lset.Hash()%uint64(r.shards)) == r.shard
+	}), nil
+}
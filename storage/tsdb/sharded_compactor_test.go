@@ -0,0 +1,55 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"testing"
+
+	"github.com/oklog/ulid"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeLeveledCompactor stands in for a *tsdb.LeveledCompactor. Write returns
+// the zero ULID for every other call, mimicking a shard whose filtered view
+// contains no series - the case that occurs whenever CompactionShards
+// exceeds a block's distinct label-hash buckets.
+type fakeLeveledCompactor struct {
+	writeCalls int
+}
+
+func (c *fakeLeveledCompactor) Write(dest string, b tsdb.BlockReader, mint, maxt int64, parent *tsdb.BlockMeta) (ulid.ULID, error) {
+	c.writeCalls++
+	if c.writeCalls%2 == 0 {
+		return ulid.ULID{}, nil
+	}
+	return ulid.MustNew(uint64(c.writeCalls), nil), nil
+}
+
+func (c *fakeLeveledCompactor) Compact(dest string, dirs []string, open []*tsdb.Block) (ulid.ULID, error) {
+	return ulid.ULID{}, nil
+}
+
+func (c *fakeLeveledCompactor) Plan(dir string) ([]string, error) { return nil, nil }
+
+func TestShardedCompactorWriteSkipsEmptyShards(t *testing.T) {
+	fake := &fakeLeveledCompactor{}
+	c := NewShardedCompactor(fake, 4)
+	c.stamp = func(dest string, id ulid.ULID, shard, shards int) error { return nil }
+
+	ids, err := c.Write(t.TempDir(), nil, 0, 1000, nil)
+	require.NoError(t, err)
+	require.Equal(t, 4, fake.writeCalls, "Write must still be attempted for every shard")
+	require.Len(t, ids, 2, "shards whose filtered view had no series must not appear in the result")
+}
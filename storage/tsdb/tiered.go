@@ -0,0 +1,282 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/oklog/ulid"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+// Bucket is the remote object-storage backend a TieredStorage ships
+// finalized blocks to. Implementations wrap a specific provider (S3, GCS,
+// Azure, ...).
+type Bucket interface {
+	// Upload stores the object at name, reading its content from r.
+	Upload(ctx context.Context, name string, r io.Reader) error
+	// Download returns a reader for the object at name.
+	Download(ctx context.Context, name string) (io.ReadCloser, error)
+	// Iter calls f with the name of every object under dir.
+	Iter(ctx context.Context, dir string, f func(name string) error) error
+	// Delete removes the object at name.
+	Delete(ctx context.Context, name string) error
+}
+
+// TieredStorage composes a local TSDB with a remote Bucket: blocks younger
+// than LocalRetention are served locally; once a block has been shipped to
+// the bucket it is dropped from local disk and served from the bucket
+// instead.
+type TieredStorage struct {
+	logger log.Logger
+	local  *tsdb.DB
+	bucket Bucket
+
+	localRetention time.Duration
+
+	shippedBlocks     prometheus.Counter
+	shipperLagSeconds prometheus.Gauge
+	remoteBlocks      prometheus.Gauge
+
+	shipperMtx sync.Mutex
+	shipped    map[ulid.ULID]struct{}
+	quit       chan struct{}
+	done       chan struct{}
+}
+
+// NewTieredStorage wraps db so that blocks older than localRetention are
+// shipped to bucket, dropped from local disk once the upload succeeds, and
+// thereafter served through a bucketQuerier. Metrics are registered against
+// r, mirroring registerMetrics's handling of the caller-supplied registerer
+// elsewhere in this package; r may be nil to skip registration (e.g. in
+// tests).
+func NewTieredStorage(l log.Logger, db *tsdb.DB, bucket Bucket, localRetention time.Duration, r prometheus.Registerer) *TieredStorage {
+	if l == nil {
+		l = log.NewNopLogger()
+	}
+	ts := &TieredStorage{
+		logger:         l,
+		local:          db,
+		bucket:         bucket,
+		localRetention: localRetention,
+		shipped:        map[ulid.ULID]struct{}{},
+		quit:           make(chan struct{}),
+		done:           make(chan struct{}),
+		shippedBlocks: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "prometheus_tsdb_shipper_uploaded_blocks_total",
+			Help: "Total number of blocks successfully uploaded to the remote bucket.",
+		}),
+		shipperLagSeconds: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_tsdb_shipper_lag_seconds",
+			Help: "Age of the oldest local block that is eligible for shipping but not yet uploaded.",
+		}),
+		remoteBlocks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "prometheus_tsdb_shipper_remote_blocks",
+			Help: "Number of blocks currently shipped to the remote bucket.",
+		}),
+	}
+	if r != nil {
+		r.MustRegister(ts.shippedBlocks, ts.shipperLagSeconds, ts.remoteBlocks)
+	}
+	go ts.run()
+	return ts
+}
+
+// run is the background shipper goroutine: it periodically uploads newly
+// finalized blocks that have aged past localRetention.
+func (ts *TieredStorage) run() {
+	defer close(ts.done)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ts.quit:
+			return
+		case <-ticker.C:
+			if err := ts.shipOnce(context.Background()); err != nil {
+				level.Error(ts.logger).Log("msg", "shipping blocks to remote bucket failed", "err", err)
+			}
+		}
+	}
+}
+
+func (ts *TieredStorage) shipOnce(ctx context.Context) error {
+	cutoff := time.Now().Add(-ts.localRetention)
+
+	ts.shipperMtx.Lock()
+	defer ts.shipperMtx.Unlock()
+
+	var oldestPending time.Time
+	for _, b := range ts.local.Blocks() {
+		meta := b.Meta()
+		if _, ok := ts.shipped[meta.ULID]; ok {
+			continue
+		}
+		if time.UnixMilli(meta.MaxTime).After(cutoff) {
+			continue
+		}
+		if err := ts.shipBlock(ctx, b); err != nil {
+			if oldestPending.IsZero() || time.UnixMilli(meta.MaxTime).Before(oldestPending) {
+				oldestPending = time.UnixMilli(meta.MaxTime)
+			}
+			ts.shipperLagSeconds.Set(time.Since(oldestPending).Seconds())
+			return errors.Wrapf(err, "ship block %s", meta.ULID)
+		}
+		ts.shipped[meta.ULID] = struct{}{}
+		ts.shippedBlocks.Inc()
+		ts.remoteBlocks.Set(float64(len(ts.shipped)))
+
+		// The block now lives in the bucket; drop it from local disk so
+		// LocalRetention actually bounds disk usage and Querier doesn't
+		// have to merge the same data from both tiers.
+		if err := ts.local.DropBlock(meta.ULID); err != nil {
+			level.Error(ts.logger).Log("msg", "failed to drop block from local disk after shipping", "block", meta.ULID, "err", err)
+		}
+	}
+
+	if oldestPending.IsZero() {
+		ts.shipperLagSeconds.Set(0)
+	} else {
+		ts.shipperLagSeconds.Set(time.Since(oldestPending).Seconds())
+	}
+	return nil
+}
+
+// shipBlock uploads a block's files followed by a meta.json marker so a
+// concurrent reader never observes a partially-uploaded block.
+func (ts *TieredStorage) shipBlock(ctx context.Context, b *tsdb.Block) error {
+	dir := b.Dir()
+	meta := b.Meta()
+
+	for _, name := range []string{"index", "tombstones"} {
+		if err := ts.uploadFile(ctx, dir, meta.ULID, name); err != nil {
+			return err
+		}
+	}
+	if err := ts.uploadDir(ctx, dir, meta.ULID, "chunks"); err != nil {
+		return err
+	}
+	// meta.json (and the thanos.json-style marker) go last: their presence
+	// in the bucket is what tells a reader the block is fully uploaded.
+	if err := ts.uploadFile(ctx, dir, meta.ULID, "meta.json"); err != nil {
+		return err
+	}
+	return ts.uploadFile(ctx, dir, meta.ULID, "thanos.json")
+}
+
+func (ts *TieredStorage) uploadFile(ctx context.Context, dir string, id ulid.ULID, name string) error {
+	f, err := os.Open(dir + "/" + name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return ts.bucket.Upload(ctx, id.String()+"/"+name, f)
+}
+
+func (ts *TieredStorage) uploadDir(ctx context.Context, dir string, id ulid.ULID, sub string) error {
+	entries, err := ioutil.ReadDir(dir + "/" + sub)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := ts.uploadFile(ctx, dir+"/"+sub, id, sub+"/"+e.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync force-flushes any blocks eligible for shipping and blocks until the
+// upload completes, instead of waiting for the next tick of run().
+func (ts *TieredStorage) Sync(ctx context.Context) error {
+	return ts.shipOnce(ctx)
+}
+
+// Close stops the background shipper goroutine.
+func (ts *TieredStorage) Close() error {
+	close(ts.quit)
+	<-ts.done
+	return ts.local.Close()
+}
+
+// StartTime consults the remote bucket's earliest block when no local
+// blocks are present, so queriers still see the full retained history.
+func (ts *TieredStorage) StartTime() (int64, error) {
+	if len(ts.local.Blocks()) > 0 {
+		return ts.local.Blocks()[0].Meta().MinTime, nil
+	}
+
+	dirs, err := listBlockDirs(context.Background(), ts.bucket)
+	if err != nil {
+		return 0, err
+	}
+
+	var earliest int64 = int64(^uint64(0) >> 1)
+	found := false
+	for _, dir := range dirs {
+		meta, err := readRemoteMeta(context.Background(), ts.bucket, dir)
+		if err != nil {
+			level.Warn(ts.logger).Log("msg", "failed to read meta for remote block", "block", dir, "err", err)
+			continue
+		}
+		if !found || meta.MinTime < earliest {
+			earliest = meta.MinTime
+			found = true
+		}
+	}
+	if !found {
+		return 0, ErrNotReady
+	}
+	return earliest, nil
+}
+
+// Querier returns a storage.Querier that reads from the local TSDB and,
+// only when the requested range reaches further back than the oldest local
+// block, fans out to the remote bucket too. Once a shipped block is
+// dropped from local disk this is the only range for which the bucket
+// holds data the local DB doesn't, so there's no need to query it twice.
+func (ts *TieredStorage) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	localQ, err := ts.local.Querier(mint, maxt)
+	if err != nil {
+		return nil, err
+	}
+	if !ts.needsBucket(mint) {
+		return querier{q: localQ}, nil
+	}
+
+	bq := &bucketQuerier{ctx: ctx, bucket: ts.bucket, mint: mint, maxt: maxt}
+	return querier{q: storage.NewMergeQuerier([]storage.Querier{querier{q: localQ}, bq}, nil, storage.ChainedSeriesMerge)}, nil
+}
+
+// needsBucket reports whether a query starting at mint can reach data that
+// has already been shipped off local disk.
+func (ts *TieredStorage) needsBucket(mint int64) bool {
+	blocks := ts.local.Blocks()
+	if len(blocks) == 0 {
+		return true
+	}
+	return mint < blocks[0].Meta().MinTime
+}
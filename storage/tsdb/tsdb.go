@@ -23,6 +23,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/pkg/histogram"
 	"github.com/prometheus/prometheus/pkg/labels"
 	"github.com/prometheus/prometheus/storage"
 	"github.com/prometheus/prometheus/tsdb"
@@ -94,6 +95,16 @@ func (s *ReadyStorage) Close() error {
 	return nil
 }
 
+// Sync force-flushes the tiering shipper for the underlying storage, if one
+// is configured. It returns ErrNotReady if the storage isn't ready yet, and
+// is a no-op if the storage isn't tiered.
+func (s *ReadyStorage) Sync(ctx context.Context) error {
+	if x := s.get(); x != nil {
+		return x.Sync(ctx)
+	}
+	return ErrNotReady
+}
+
 // Adapter return an adapter as storage.Storage.
 func Adapter(db *tsdb.DB, startTimeMargin int64) storage.Storage {
 	return &adapter{db: db, startTimeMargin: startTimeMargin}
@@ -132,6 +143,39 @@ type Options struct {
 
 	// When true records in the WAL will be compressed.
 	WALCompression bool
+
+	// When true, the appender accepts native (sparse) histogram samples and
+	// the underlying TSDB persists them in dedicated histogram chunks.
+	EnableNativeHistograms bool
+
+	// CompactionShards is the number of shards used by the "split-merge"
+	// CompactionStrategy: each compaction first splits source blocks into
+	// CompactionShards shard-labeled blocks by labels.Hash()%CompactionShards,
+	// then merges same-shard blocks across time ranges. Values below one are
+	// treated as one. It has no effect under any other CompactionStrategy.
+	CompactionShards int
+
+	// CompactionStrategy selects the compaction algorithm to use. Defaults to
+	// "leveled" (the historical behavior); "split-merge" enables the sharded
+	// two-phase compactor configured by CompactionShards.
+	CompactionStrategy string
+
+	// RemoteBucket, when set, enables tiering: blocks older than
+	// LocalRetention are shipped to the bucket and subsequently served from
+	// there instead of local disk.
+	RemoteBucket Bucket
+
+	// LocalRetention is how long a finalized block is kept on local disk
+	// before the shipper uploads it to RemoteBucket. Only meaningful when
+	// RemoteBucket is set.
+	LocalRetention model.Duration
+
+	// OutOfOrderTimeWindow, when non-zero, allows samples up to that
+	// duration behind the head's max time to be accepted into a separate
+	// out-of-order head instead of being rejected with
+	// storage.ErrOutOfOrderSample. Enabling it forces AllowOverlappingBlocks,
+	// since flushing the out-of-order head produces overlapping blocks.
+	OutOfOrderTimeWindow model.Duration
 }
 
 var (
@@ -190,29 +234,131 @@ func Open(path string, l log.Logger, r prometheus.Registerer, opts *Options) (*t
 		}
 	}
 
+	allowOverlapping := opts.AllowOverlappingBlocks
+	if opts.OutOfOrderTimeWindow > 0 {
+		// Flushing the out-of-order head produces blocks that overlap
+		// existing ones, so vertical compaction and query merge must be on.
+		allowOverlapping = true
+	}
+	if opts.CompactionStrategy == CompactionStrategySplitMerge {
+		// The split phase deliberately writes one sibling block per shard
+		// covering the same source time range, so the DB must tolerate (and
+		// vertically merge) overlapping blocks for those siblings to be
+		// queryable before the merge phase runs.
+		allowOverlapping = true
+	}
+
 	db, err := tsdb.Open(path, l, r, &tsdb.Options{
 		WALSegmentSize:         int(opts.WALSegmentSize),
 		RetentionDuration:      uint64(time.Duration(opts.RetentionDuration).Seconds() * 1000),
 		MaxBytes:               int64(opts.MaxBytes),
 		BlockRanges:            rngs,
 		NoLockfile:             opts.NoLockfile,
-		AllowOverlappingBlocks: opts.AllowOverlappingBlocks,
+		AllowOverlappingBlocks: allowOverlapping,
 		WALCompression:         opts.WALCompression,
+		EnableNativeHistograms: opts.EnableNativeHistograms,
 	})
 	if err != nil {
 		return nil, err
 	}
+
+	if opts.OutOfOrderTimeWindow > 0 {
+		oooDir := path + "/ooo"
+		walLog := openOOOWAL(db.Head().WAL())
+		h := newOOOHead(int64(time.Duration(opts.OutOfOrderTimeWindow)/time.Millisecond), walLog, r)
+		if err := replayOOOWAL(l, db.Head().WAL().Dir(), h); err != nil {
+			return nil, errors.Wrap(err, "replay out-of-order wal")
+		}
+		flusher := newOOOFlusher(l, db, h, oooDir)
+		setOOOFor(db, h, flusher)
+	}
+
+	if opts.CompactionStrategy == CompactionStrategySplitMerge {
+		leveled, err := tsdb.NewLeveledCompactor(context.Background(), r, l, rngs, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "create leveled compactor for sharded compaction")
+		}
+		shards := opts.CompactionShards
+		if shards < 1 {
+			shards = 1
+		}
+		db.SetCompactor(NewShardedCompactor(leveled, shards))
+	}
+
+	if opts.RemoteBucket != nil {
+		setTieredFor(db, NewTieredStorage(l, db, opts.RemoteBucket, time.Duration(opts.LocalRetention), r))
+	}
+
 	registerMetrics(db, r)
 
 	return db, nil
 }
 
+// tieredStorages tracks, for each DB opened with a RemoteBucket configured,
+// the TieredStorage shipping its blocks. adapter consults it so the same
+// *tsdb.DB can be handed to both Open's caller and the storage.Storage
+// adapter without threading a TieredStorage through every call site.
+var (
+	tieredMtx sync.Mutex
+	tiered    = map[*tsdb.DB]*TieredStorage{}
+)
+
+func setTieredFor(db *tsdb.DB, ts *TieredStorage) {
+	tieredMtx.Lock()
+	defer tieredMtx.Unlock()
+	tiered[db] = ts
+}
+
+func tieredFor(db *tsdb.DB) *TieredStorage {
+	tieredMtx.Lock()
+	defer tieredMtx.Unlock()
+	return tiered[db]
+}
+
+// oooState bundles a DB's out-of-order buffer with the background flusher
+// that drains it, so Close can stop the flusher along with everything else.
+type oooState struct {
+	head    *oooHead
+	flusher *oooFlusher
+}
+
+// oooHeads tracks, for each DB opened with OutOfOrderTimeWindow configured,
+// the buffer of late samples awaiting head compaction. Keyed the same way
+// as tiered above, for the same reason: appender and querier only ever see
+// the *tsdb.DB, not the Options that configured it.
+var (
+	oooMtx   sync.Mutex
+	oooHeads = map[*tsdb.DB]*oooState{}
+)
+
+func setOOOFor(db *tsdb.DB, h *oooHead, flusher *oooFlusher) {
+	oooMtx.Lock()
+	defer oooMtx.Unlock()
+	oooHeads[db] = &oooState{head: h, flusher: flusher}
+}
+
+func oooFor(db *tsdb.DB) *oooHead {
+	oooMtx.Lock()
+	defer oooMtx.Unlock()
+	s := oooHeads[db]
+	if s == nil {
+		return nil
+	}
+	return s.head
+}
+
 // StartTime implements the Storage interface.
 func (a adapter) StartTime() (int64, error) {
 	var startTime int64
 
 	if len(a.db.Blocks()) > 0 {
 		startTime = a.db.Blocks()[0].Meta().MinTime
+	} else if ts := tieredFor(a.db); ts != nil {
+		remote, err := ts.StartTime()
+		if err != nil {
+			return 0, err
+		}
+		startTime = remote
 	} else {
 		startTime = time.Now().Unix() * 1000
 	}
@@ -221,26 +367,58 @@ func (a adapter) StartTime() (int64, error) {
 	return startTime + a.startTimeMargin, nil
 }
 
-func (a adapter) Querier(_ context.Context, mint, maxt int64) (storage.Querier, error) {
+func (a adapter) Querier(ctx context.Context, mint, maxt int64) (storage.Querier, error) {
+	if ts := tieredFor(a.db); ts != nil {
+		return ts.Querier(ctx, mint, maxt)
+	}
+
 	q, err := a.db.Querier(mint, maxt)
 	if err != nil {
 		return nil, err
 	}
-	return querier{q: q}, nil
+	// db.Querier already vertically merges overlapping blocks, which is all
+	// that's needed to deduplicate series split across shard-labeled blocks
+	// produced by the sharded compactor: shards only ever partition series
+	// within a single source block, so two blocks sharing a shard ID never
+	// hold the same series outside of that merge.
+	return querier{q: q, ooo: oooFor(a.db)}, nil
+}
+
+// Sync force-flushes the tiering shipper, if one is configured for this
+// adapter's DB. It is a no-op otherwise.
+func (a adapter) Sync(ctx context.Context) error {
+	if ts := tieredFor(a.db); ts != nil {
+		return ts.Sync(ctx)
+	}
+	return nil
 }
 
 // Appender returns a new appender against the storage.
 func (a adapter) Appender() (storage.Appender, error) {
-	return appender{a: a.db.Appender()}, nil
+	return appender{a: a.db.Appender(), db: a.db, ooo: oooFor(a.db)}, nil
 }
 
 // Close closes the storage and all its underlying resources.
 func (a adapter) Close() error {
+	oooMtx.Lock()
+	s := oooHeads[a.db]
+	delete(oooHeads, a.db)
+	oooMtx.Unlock()
+	if s != nil && s.flusher != nil {
+		s.flusher.Close()
+	}
+	if ts := tieredFor(a.db); ts != nil {
+		tieredMtx.Lock()
+		delete(tiered, a.db)
+		tieredMtx.Unlock()
+		return ts.Close()
+	}
 	return a.db.Close()
 }
 
 type querier struct {
-	q storage.Querier
+	q   storage.Querier
+	ooo *oooHead
 }
 
 func (q querier) Select(p *storage.SelectParams, ms ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
@@ -248,7 +426,7 @@ func (q querier) Select(p *storage.SelectParams, ms ...*labels.Matcher) (storage
 	if err != nil {
 		return nil, ws, err
 	}
-	return seriesSet{set: set}, ws, nil
+	return seriesSet{set: set, ooo: q.ooo}, ws, nil
 }
 
 func (q querier) SelectSorted(p *storage.SelectParams, ms ...*labels.Matcher) (storage.SeriesSet, storage.Warnings, error) {
@@ -256,7 +434,7 @@ func (q querier) SelectSorted(p *storage.SelectParams, ms ...*labels.Matcher) (s
 	if err != nil {
 		return nil, ws, err
 	}
-	return seriesSet{set: set}, ws, nil
+	return seriesSet{set: set, ooo: q.ooo}, ws, nil
 }
 
 func (q querier) LabelValues(name string) ([]string, storage.Warnings, error) {
@@ -269,26 +447,53 @@ func (q querier) Close() error { return q.q.Close() }
 
 type seriesSet struct {
 	set storage.SeriesSet
+	ooo *oooHead
 }
 
-func (s seriesSet) Next() bool         { return s.set.Next() }
-func (s seriesSet) Err() error         { return s.set.Err() }
-func (s seriesSet) At() storage.Series { return series{s: s.set.At()} }
+func (s seriesSet) Next() bool { return s.set.Next() }
+func (s seriesSet) Err() error { return s.set.Err() }
+func (s seriesSet) At() storage.Series {
+	return series{s: s.set.At(), ooo: s.ooo}
+}
 
 type series struct {
-	s storage.Series
+	s   storage.Series
+	ooo *oooHead
 }
 
-func (s series) Labels() labels.Labels       { return s.s.Labels() }
-func (s series) Iterator() chunkenc.Iterator { return s.s.Iterator() }
+func (s series) Labels() labels.Labels { return s.s.Labels() }
+
+// Iterator returns a chunkenc.Iterator over the series' samples. The
+// returned iterator always implements AtHistogram (see histogramIterator),
+// which yields the native histogram when the underlying chunks hold them.
+// If an out-of-order buffer is configured, its samples for this series are
+// k-way merged in, deduplicating identical (t, v) pairs against the
+// in-order iterator.
+func (s series) Iterator() chunkenc.Iterator {
+	it := newHistogramIterator(s.s.Iterator())
+	if s.ooo == nil {
+		return it
+	}
+	buffered := s.ooo.samples(s.Labels().Hash())
+	if len(buffered) == 0 {
+		return it
+	}
+	return newOOOMergeIterator(it, buffered)
+}
 
 type appender struct {
-	a tsdb.Appender
+	a   tsdb.Appender
+	db  *tsdb.DB
+	ooo *oooHead
 }
 
 func (a appender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
 	ref, err := a.a.Add(lset, t, v)
 
+	if errors.Cause(err) == tsdb.ErrOutOfOrderSample && a.bufferOOO(lset, t, v) {
+		return ref, nil
+	}
+
 	switch errors.Cause(err) {
 	case tsdb.ErrNotFound:
 		return 0, storage.ErrNotFound
@@ -302,9 +507,56 @@ func (a appender) Add(lset labels.Labels, t int64, v float64) (uint64, error) {
 	return ref, err
 }
 
-func (a appender) AddFast(_ labels.Labels, ref uint64, t int64, v float64) error {
+func (a appender) AddFast(lset labels.Labels, ref uint64, t int64, v float64) error {
 	err := a.a.AddFast(ref, t, v)
 
+	// Key the out-of-order buffer by the series' label hash rather than its
+	// internal tsdb ref, so the querier (which only sees labels.Labels) can
+	// look the buffer back up when merging it with the in-order iterator.
+	if errors.Cause(err) == tsdb.ErrOutOfOrderSample && a.bufferOOO(lset, t, v) {
+		return nil
+	}
+
+	switch errors.Cause(err) {
+	case tsdb.ErrNotFound:
+		return storage.ErrNotFound
+	case tsdb.ErrOutOfOrderSample:
+		return storage.ErrOutOfOrderSample
+	case tsdb.ErrAmendSample:
+		return storage.ErrDuplicateSampleForTimestamp
+	case tsdb.ErrOutOfBounds:
+		return storage.ErrOutOfBounds
+	}
+	return err
+}
+
+// bufferOOO buffers a sample that tsdb.Appender rejected as out-of-order
+// into the out-of-order head, if one is configured and the sample falls
+// within its time window. It reports whether the sample was buffered.
+func (a appender) bufferOOO(lset labels.Labels, t int64, v float64) bool {
+	if a.ooo == nil {
+		return false
+	}
+	if !a.ooo.accepts(t, a.db.Head().MaxTime()) {
+		a.ooo.tooOld.Inc()
+		return false
+	}
+	a.ooo.insert(lset.Hash(), lset, t, v)
+	return true
+}
+
+// AddHistogram adds a native histogram sample for the series identified by lset.
+func (a appender) AddHistogram(lset labels.Labels, t int64, h *histogram.Histogram) (uint64, error) {
+	ref, err := a.a.AppendHistogram(lset, t, h)
+	return ref, translateHistogramErr(err)
+}
+
+// AddFastHistogram adds a native histogram sample against an already resolved series ref.
+func (a appender) AddFastHistogram(_ labels.Labels, ref uint64, t int64, h *histogram.Histogram) error {
+	return translateHistogramErr(a.a.AppendHistogramFast(ref, t, h))
+}
+
+func translateHistogramErr(err error) error {
 	switch errors.Cause(err) {
 	case tsdb.ErrNotFound:
 		return storage.ErrNotFound
@@ -314,6 +566,10 @@ func (a appender) AddFast(_ labels.Labels, ref uint64, t int64, v float64) error
 		return storage.ErrDuplicateSampleForTimestamp
 	case tsdb.ErrOutOfBounds:
 		return storage.ErrOutOfBounds
+	case tsdb.ErrHistogramCountNotBigEnough:
+		return storage.ErrHistogramCountNotBigEnough
+	case tsdb.ErrHistogramSpanNegativeOffset:
+		return storage.ErrHistogramSpanNegativeOffset
 	}
 	return err
 }
@@ -0,0 +1,147 @@
+// Copyright 2017 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tsdb
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/pkg/errors"
+	"github.com/prometheus/prometheus/pkg/labels"
+	"github.com/prometheus/prometheus/tsdb/wal"
+)
+
+// oooRecordType identifies an out-of-order sample record in the WAL,
+// alongside the tsdb package's own record.Type values. It's chosen well
+// clear of that range so a reader walking the log can tell the two apart.
+const oooRecordType = byte(224)
+
+// encodeOOORecord serializes a single buffered out-of-order sample as a WAL
+// record: type byte, series ref, label count, (name, value) pairs, then
+// timestamp and value. Encoding one sample per record keeps replay simple at
+// the cost of some duplication across records for the same series; that
+// trade mirrors the out-of-order buffer itself, which is expected to stay
+// small relative to the head.
+func encodeOOORecord(ref uint64, lset labels.Labels, t int64, v float64) []byte {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, oooRecordType)
+	buf = appendUvarint(buf, ref)
+	buf = appendUvarint(buf, uint64(len(lset)))
+	for _, l := range lset {
+		buf = appendUvarint(buf, uint64(len(l.Name)))
+		buf = append(buf, l.Name...)
+		buf = appendUvarint(buf, uint64(len(l.Value)))
+		buf = append(buf, l.Value...)
+	}
+	var tb [8]byte
+	binary.BigEndian.PutUint64(tb[:], uint64(t))
+	buf = append(buf, tb[:]...)
+	binary.BigEndian.PutUint64(tb[:], math.Float64bits(v))
+	buf = append(buf, tb[:]...)
+	return buf
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+// decodeOOORecord is the inverse of encodeOOORecord.
+func decodeOOORecord(rec []byte) (ref uint64, lset labels.Labels, t int64, v float64, err error) {
+	if len(rec) == 0 || rec[0] != oooRecordType {
+		return 0, nil, 0, 0, errors.New("ooo wal: not an out-of-order sample record")
+	}
+	b := rec[1:]
+
+	ref, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, 0, 0, errors.New("ooo wal: truncated series ref")
+	}
+	b = b[n:]
+
+	numLabels, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, 0, 0, errors.New("ooo wal: truncated label count")
+	}
+	b = b[n:]
+
+	lset = make(labels.Labels, 0, numLabels)
+	for i := uint64(0); i < numLabels; i++ {
+		name, rest, err := decodeOOOString(b)
+		if err != nil {
+			return 0, nil, 0, 0, err
+		}
+		b = rest
+		value, rest, err := decodeOOOString(b)
+		if err != nil {
+			return 0, nil, 0, 0, err
+		}
+		b = rest
+		lset = append(lset, labels.Label{Name: name, Value: value})
+	}
+
+	if len(b) < 16 {
+		return 0, nil, 0, 0, errors.New("ooo wal: truncated sample")
+	}
+	t = int64(binary.BigEndian.Uint64(b[:8]))
+	v = math.Float64frombits(binary.BigEndian.Uint64(b[8:16]))
+	return ref, lset, t, v, nil
+}
+
+func decodeOOOString(b []byte) (string, []byte, error) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || uint64(len(b)-n) < l {
+		return "", nil, errors.New("ooo wal: truncated string")
+	}
+	return string(b[n : n+int(l)]), b[n+int(l):], nil
+}
+
+// openOOOWAL returns a function that appends an encoded out-of-order record
+// to db's WAL, so buffered samples survive a restart instead of only living
+// in the oooHead's in-memory map.
+func openOOOWAL(w *wal.WAL) func([]byte) error {
+	return func(rec []byte) error {
+		return w.Log(rec)
+	}
+}
+
+// replayOOOWAL reads every out-of-order record out of the WAL under dir and
+// re-inserts it into h, reconstructing the buffer a restart would otherwise
+// have lost. It's called from Open before the out-of-order head starts
+// accepting new appends.
+func replayOOOWAL(l log.Logger, dir string, h *oooHead) error {
+	sr, err := wal.NewSegmentsReader(dir)
+	if err != nil {
+		return errors.Wrap(err, "open wal segments for ooo replay")
+	}
+	defer sr.Close()
+
+	reader := wal.NewReader(sr)
+	for reader.Next() {
+		rec := reader.Record()
+		if len(rec) == 0 || rec[0] != oooRecordType {
+			continue
+		}
+		ref, lset, t, v, err := decodeOOORecord(rec)
+		if err != nil {
+			level.Warn(l).Log("msg", "skipping corrupt out-of-order wal record", "err", err)
+			continue
+		}
+		h.insertReplayed(ref, lset, t, v)
+	}
+	return reader.Err()
+}